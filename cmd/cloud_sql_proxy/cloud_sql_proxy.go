@@ -53,9 +53,12 @@ var (
 	verbose        = flag.Bool("verbose", true, "If false, verbose output such as information about when connections are created/closed without error are suppressed")
 	quiet          = flag.Bool("quiet", false, "Disable log messages")
 	logDebugStdout = flag.Bool("log_debug_stdout", false, "If true, log messages that are not errors will output to stdout instead of stderr")
+	structuredLogs = flag.Bool("structured_logs", false, "If true, log messages are written as JSON objects (one per line) instead of plain text")
+	accessLog      = flag.Bool("access_log", false, "If true, one line is logged for each connection when it closes, recording the instance, addresses, duration, bytes transferred and which side closed it")
 
-	refreshCfgThrottle = flag.Duration("refresh_config_throttle", proxy.DefaultRefreshCfgThrottle, "If set, this flag specifies the amount of forced sleep between successive API calls in order to protect client API quota. Minimum allowed value is "+minimumRefreshCfgThrottle.String())
-	checkRegion        = flag.Bool("check_region", false, `If specified, the 'region' portion of the connection string is required for
+	refreshCfgThrottle   = flag.Duration("refresh_config_throttle", proxy.DefaultRefreshCfgThrottle, "If set, this flag specifies the amount of forced sleep between successive API calls in order to protect client API quota. Minimum allowed value is "+minimumRefreshCfgThrottle.String())
+	slowRefreshThreshold = flag.Duration("slow_refresh_threshold", proxy.DefaultSlowRefreshThreshold, "A warning is logged when fetching an instance's certificates and address from the Cloud SQL API takes longer than this. A negative value disables the warning")
+	checkRegion          = flag.Bool("check_region", false, `If specified, the 'region' portion of the connection string is required for
 Unix socket-based connections.`)
 
 	// Settings for how to choose which instance to connect to.
@@ -75,16 +78,38 @@ provide 'instance/attributes/cloud-sql-instances'. Not compatible with -fuse`)
 directory at 'dir' must be empty before this program is started.`)
 	fuseTmp = flag.String("fuse_tmp", defaultTmp, `Used as a temporary directory if -fuse is set. Note that files in this directory
 can be removed automatically by this program.`)
+	allowedInstances = flag.String("allowed_instances", "", `If provided, a comma-separated list of the only instances the proxy will
+connect to. An entry of the form 'project:region:*' allows every instance in
+that region. Connections for other instances are closed. Useful with -fuse,
+where clients choose the instance.`)
 
 	// Settings for limits
-	maxConnections = flag.Uint64("max_connections", 0, `If provided, the maximum number of connections to establish before refusing new connections. Defaults to 0 (no limit)`)
-	fdRlimit       = flag.Uint64("fd_rlimit", limits.ExpectedFDs, `Sets the rlimit on the number of open file descriptors for the proxy to the provided value. If set to zero, disables attempts to set the rlimit. Defaults to a value which can support 4K connections to one instance`)
-	termTimeout    = flag.Duration("term_timeout", 0, "When set, the proxy will wait for existing connections to close before terminating. Any connections that haven't closed after the timeout will be dropped")
+	maxConnections     = flag.Uint64("max_connections", 0, `If provided, the maximum number of connections to establish before refusing new connections. Defaults to 0 (no limit)`)
+	fdRlimit           = flag.Uint64("fd_rlimit", limits.ExpectedFDs, `Sets the rlimit on the number of open file descriptors for the proxy to the provided value. If set to zero, disables attempts to set the rlimit. Defaults to a value which can support 4K connections to one instance`)
+	termTimeout        = flag.Duration("term_timeout", 0, "When set, the proxy will wait for existing connections to close before terminating. Any connections that haven't closed after the timeout will be dropped")
+	idleTimeout        = flag.Duration("idle_timeout", 0, "When set, connections on which no data has been sent in either direction for this long are closed. Defaults to 0 (no timeout)")
+	bufferSize         = flag.Int("buffer_size", 0, "Size in bytes of the buffer used to copy data in each direction of a connection. Larger values can help bulk transfers. Defaults to 16 KiB")
+	drainTimeout       = flag.Duration("drain_timeout", 0, "When set, data from the instance is still forwarded for up to this long after a client closes its side of a connection. Defaults to 0 (close immediately)")
+	writeTimeout       = flag.Duration("write_timeout", 0, "When set, connections are closed if sending data from the instance to a client takes longer than this, for example because the client stopped reading. Defaults to 0 (no timeout)")
+	initialReadTimeout = flag.Duration("initial_read_timeout", 0, "When set, connections are closed if the client has sent no data this long after the connection to the instance was opened. With MySQL, whose server speaks first, this must allow for the handshake. Defaults to 0 (no timeout)")
+	maxConnAge         = flag.Duration("max_connection_age", 0, "When set, connections are closed this long after they were opened, even if they are in use, so that clients reconnect. Defaults to 0 (no limit)")
+
+	// Settings for health checks
+	healthCheckAddr = flag.String("health_check_address", "", `If provided, an HTTP server is started on this address (e.g. ':8090') serving
+'/liveness' and '/readiness' endpoints. Readiness is reported once a certificate
+has been obtained for at least one instance.`)
 
 	// Settings for authentication.
 	token     = flag.String("token", "", "When set, the proxy uses this Bearer token for authorization.")
 	tokenFile = flag.String("credential_file", "", `If provided, this json file will be used to retrieve Service Account credentials.
 You may set the GOOGLE_APPLICATION_CREDENTIALS environment variable for the same effect.`)
+	impersonateServiceAccount = flag.String("impersonate_service_account", "", `If provided, the proxy impersonates this service account, using its configured
+credentials to obtain access tokens. A comma-separated list may be given to use a
+delegation chain, in which case the last entry is the target service account.`)
+	oauthScopesList = flag.String("oauth_scopes", "", `Comma-separated list of additional OAuth2 scopes to request for the proxy's
+credentials. The scope required to access Cloud SQL is always included.`)
+	quotaProject = flag.String("quota_project", "", `If provided, this project is billed for, and its quota used by, the proxy's
+Cloud SQL Admin API requests. This is typically needed with user credentials.`)
 	ipAddressTypes = flag.String("ip_address_types", "PUBLIC,PRIVATE", "Default to be 'PUBLIC,PRIVATE'. Options: a list of strings separated by ',', e.g. 'PUBLIC,PRIVATE' ")
 
 	skipInvalidInstanceConfigs = flag.Bool("skip_failed_instance_config", false, `Setting this flag will allow you to prevent the proxy from terminating when
@@ -97,6 +122,8 @@ You may set the GOOGLE_APPLICATION_CREDENTIALS environment variable for the same
 const (
 	minimumRefreshCfgThrottle = time.Second
 
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
 	port = 3307
 )
 
@@ -123,6 +150,11 @@ Authorization:
     This will override gcloud or GCE (Google Compute Engine) credentials,
     if they exist.
 
+  * To connect as a different service account than the one configured above,
+    pass its email to the -impersonate_service_account parameter. The
+    credentials in use must have the Service Account Token Creator role
+    (roles/iam.serviceAccountTokenCreator) on that service account.
+
 General:
   -quiet
     Disable log messages (e.g. when new connections are established).
@@ -132,6 +164,10 @@ General:
   -log_debug_stdout
     When explicitly set to true, verbose and info log messages will be directed
 	to stdout as opposed to the default stderr.
+  -structured_logs
+    When explicitly set to true, log messages are written as single-line JSON
+    objects with "severity", "message" and "timestamp" keys, which makes them
+    easier to ingest by log aggregation pipelines.
   -verbose
     When explicitly set to false, disable log messages that are not errors nor
     first-time startup messages (e.g. when new connections are established).
@@ -258,58 +294,100 @@ func checkFlags(onGCE bool) error {
 		return fmt.Errorf("error checking scopes: %T %v | %+v", err, err, err)
 	}
 
-	ok := false
+	return checkScopes(scopes, len(stringList(*impersonateServiceAccount)) > 0)
+}
+
+// checkScopes reports whether a VM service account with the given scopes can
+// be used by the proxy. Impersonation calls the IAM Credentials API, which
+// needs the cloud-platform scope; the metadata server cannot widen a token's
+// scopes after the fact.
+func checkScopes(scopes []string, impersonating bool) error {
 	for _, sc := range scopes {
-		if sc == proxy.SQLScope || sc == "https://www.googleapis.com/auth/cloud-platform" {
-			ok = true
-			break
+		if sc == cloudPlatformScope || sc == proxy.SQLScope && !impersonating {
+			return nil
 		}
 	}
-	if !ok {
-		return errors.New(`the default Compute Engine service account is not configured with sufficient permissions to access the Cloud SQL API from this VM. ` + accountErrorSuffix)
+	if impersonating {
+		return errors.New(`-impersonate_service_account requires the default Compute Engine service account to have the ` + cloudPlatformScope + ` scope. ` + accountErrorSuffix)
 	}
-	return nil
+	return errors.New(`the default Compute Engine service account is not configured with sufficient permissions to access the Cloud SQL API from this VM. ` + accountErrorSuffix)
 }
 
-func authenticatedClientFromPath(ctx context.Context, f string) (*http.Client, error) {
+func tokenSourceFromPath(ctx context.Context, f string, scopes ...string) (oauth2.TokenSource, error) {
 	all, err := ioutil.ReadFile(f)
 	if err != nil {
 		return nil, fmt.Errorf("invalid json file %q: %v", f, err)
 	}
 	// First try and load this as a service account config, which allows us to see the service account email:
-	if cfg, err := goauth.JWTConfigFromJSON(all, proxy.SQLScope); err == nil {
+	if cfg, err := goauth.JWTConfigFromJSON(all, scopes...); err == nil {
 		logging.Infof("using credential file for authentication; email=%s", cfg.Email)
-		return cfg.Client(ctx), nil
+		return cfg.TokenSource(ctx), nil
 	}
 
-	cred, err := goauth.CredentialsFromJSON(ctx, all, proxy.SQLScope)
+	cred, err := goauth.CredentialsFromJSON(ctx, all, scopes...)
 	if err != nil {
 		return nil, fmt.Errorf("invalid json file %q: %v", f, err)
 	}
 	logging.Infof("using credential file for authentication; path=%q", f)
-	return oauth2.NewClient(ctx, cred.TokenSource), nil
+	return cred.TokenSource, nil
 }
 
-func authenticatedClient(ctx context.Context) (*http.Client, error) {
+// credentialTokenSource returns a TokenSource for the credentials selected by
+// the flags and environment, requesting the provided scopes where the
+// credential type supports it.
+func credentialTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
 	if *tokenFile != "" {
-		return authenticatedClientFromPath(ctx, *tokenFile)
+		return tokenSourceFromPath(ctx, *tokenFile, scopes...)
 	} else if tok := *token; tok != "" {
-		src := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})
-		return oauth2.NewClient(ctx, src), nil
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok}), nil
 	} else if f := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); f != "" {
-		return authenticatedClientFromPath(ctx, f)
+		return tokenSourceFromPath(ctx, f, scopes...)
 	}
 
 	// If flags or env don't specify an auth source, try either gcloud or application default
 	// credentials.
 	src, err := util.GcloudTokenSource(ctx)
 	if err != nil {
-		src, err = goauth.DefaultTokenSource(ctx, proxy.SQLScope)
+		src, err = goauth.DefaultTokenSource(ctx, scopes...)
+	}
+	return src, err
+}
+
+// oauthScopes returns the scopes from -oauth_scopes, adding the scope the proxy
+// requires if it is missing.
+func oauthScopes() []string {
+	scopes := stringList(*oauthScopesList)
+	for _, sc := range scopes {
+		if sc == proxy.SQLScope {
+			return scopes
+		}
 	}
+	return append(scopes, proxy.SQLScope)
+}
+
+func authenticatedClient(ctx context.Context) (*http.Client, error) {
+	scopes := oauthScopes()
+	accounts := stringList(*impersonateServiceAccount)
+	if len(accounts) == 0 {
+		src, err := credentialTokenSource(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.NewClient(ctx, src), nil
+	}
+
+	// Calling the IAM Credentials API requires the cloud-platform scope; the
+	// impersonated token gets the requested scopes.
+	base, err := credentialTokenSource(ctx, cloudPlatformScope)
 	if err != nil {
 		return nil, err
 	}
-
+	target, delegates := accounts[len(accounts)-1], accounts[:len(accounts)-1]
+	src, err := util.ImpersonatedTokenSource(ctx, base, target, delegates, scopes)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("impersonating service account %s", target)
 	return oauth2.NewClient(ctx, src), nil
 }
 
@@ -341,7 +419,11 @@ func listInstances(ctx context.Context, cl *http.Client, projects []string) ([]s
 	for _, proj := range projects {
 		proj := proj
 		go func() {
-			err := sql.Instances.List(proj).Pages(ctx, func(r *sqladmin.InstancesListResponse) error {
+			call := sql.Instances.List(proj)
+			if *quotaProject != "" {
+				call.Header().Set(certs.QuotaProjectHeader, *quotaProject)
+			}
+			err := call.Pages(ctx, func(r *sqladmin.InstancesListResponse) error {
 				for _, in := range r.Items {
 					// The Proxy is only support on Second Gen
 					if in.BackendType == "SECOND_GEN" {
@@ -410,6 +492,10 @@ func main() {
 		logging.LogDebugToStdout()
 	}
 
+	if *structuredLogs {
+		logging.SetJSON(true)
+	}
+
 	if !*verbose {
 		logging.LogVerboseToNowhere()
 	}
@@ -497,9 +583,19 @@ func main() {
 			IgnoreRegion:   !*checkRegion,
 			UserAgent:      userAgentFromVersionString(),
 			IPAddrTypeOpts: ipAddrTypeOptsInput,
+			QuotaProject:   *quotaProject,
 		}),
-		Conns:              connset,
-		RefreshCfgThrottle: refreshCfgThrottle,
+		Conns:                connset,
+		RefreshCfgThrottle:   refreshCfgThrottle,
+		SlowRefreshThreshold: *slowRefreshThreshold,
+		AllowedInstances:     stringList(*allowedInstances),
+		IdleTimeout:          *idleTimeout,
+		MaxConnAge:           *maxConnAge,
+		AccessLog:            *accessLog,
+		BufferSize:           *bufferSize,
+		DrainTimeout:         *drainTimeout,
+		WriteTimeout:         *writeTimeout,
+		InitialReadTimeout:   *initialReadTimeout,
 	}
 
 	// Initialize a source of new connections to Cloud SQL instances.
@@ -537,6 +633,21 @@ func main() {
 		connSrc = c
 	}
 
+	if *healthCheckAddr != "" {
+		if err := startHealthCheck(*healthCheckAddr, proxyClient); err != nil {
+			log.Fatalf("Could not start health check server on %q: %v", *healthCheckAddr, err)
+		}
+		// Fetch certificates for the statically configured instances up
+		// front so that readiness does not depend on a first connection.
+		for _, cfg := range cfgs {
+			go func(instance string) {
+				if _, err := proxyClient.InstanceVersion(instance); err != nil {
+					logging.Errorf("failed to fetch configuration for %q: %v", instance, err)
+				}
+			}(cfg.Instance)
+		}
+	}
+
 	logging.Infof("Ready for new connections")
 
 	signals := make(chan os.Signal, 1)
@@ -0,0 +1,139 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+func TestOAuthScopes(t *testing.T) {
+	defer func(old string) { *oauthScopesList = old }(*oauthScopesList)
+
+	const email = "https://www.googleapis.com/auth/userinfo.email"
+	for _, tc := range []struct {
+		flag string
+		want []string
+	}{
+		{"", []string{proxy.SQLScope}},
+		{email, []string{email, proxy.SQLScope}},
+		{proxy.SQLScope + "," + email, []string{proxy.SQLScope, email}},
+	} {
+		*oauthScopesList = tc.flag
+		if got := oauthScopes(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("oauthScopes() with -oauth_scopes=%q: got %v, want %v", tc.flag, got, tc.want)
+		}
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	for _, tc := range []struct {
+		scopes        []string
+		impersonating bool
+		wantErr       bool
+	}{
+		{[]string{proxy.SQLScope}, false, false},
+		{[]string{cloudPlatformScope}, false, false},
+		{[]string{"https://www.googleapis.com/auth/userinfo.email"}, false, true},
+		{[]string{proxy.SQLScope}, true, true},
+		{[]string{proxy.SQLScope, cloudPlatformScope}, true, false},
+	} {
+		if err := checkScopes(tc.scopes, tc.impersonating); (err != nil) != tc.wantErr {
+			t.Errorf("checkScopes(%v, %v) = %v, want error: %v", tc.scopes, tc.impersonating, err, tc.wantErr)
+		}
+	}
+}
+
+// TestCredentialFileScopes verifies that the scopes are part of the token
+// request made for a service account credential file.
+func TestCredentialFileScopes(t *testing.T) {
+	var gotScope string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The JWT assertion is header.claims.signature; only the claims matter.
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Errorf("unexpected assertion %q", r.FormValue("assertion"))
+			return
+		}
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Errorf("decoding claims: %v", err)
+			return
+		}
+		var c struct {
+			Scope string `json:"scope"`
+		}
+		if err := json.Unmarshal(claims, &c); err != nil {
+			t.Errorf("unmarshaling claims: %v", err)
+		}
+		gotScope = c.Scope
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer tokenServer.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	creds, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "proxy@proj.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    tokenServer.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "credentials*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(creds); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	defer func(old string) { *tokenFile = old }(*tokenFile)
+	*tokenFile = f.Name()
+
+	scopes := []string{"https://www.googleapis.com/auth/userinfo.email", proxy.SQLScope}
+	src, err := credentialTokenSource(context.Background(), scopes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(scopes, " "); gotScope != want {
+		t.Errorf("token request scope: got %q, want %q", gotScope, want)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains the HTTP health check endpoints of the Cloud SQL Proxy,
+// meant to be used as liveness and readiness probes (e.g. in Kubernetes).
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+const (
+	livenessPath  = "/liveness"
+	readinessPath = "/readiness"
+)
+
+// healthCheckHandler serves the liveness and readiness endpoints for c.
+//
+// Liveness always succeeds while the process is serving. Readiness succeeds
+// once the client holds a valid certificate for at least one instance.
+func healthCheckHandler(c *proxy.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(livenessPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(readinessPath, func(w http.ResponseWriter, _ *http.Request) {
+		if len(c.ValidCachedInstances()) == 0 {
+			http.Error(w, "no instance has a valid certificate yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// startHealthCheck starts serving the health check endpoints for c on addr in
+// the background.
+func startHealthCheck(addr string, c *proxy.Client) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(l, healthCheckHandler(c)); err != nil {
+			logging.Errorf("health check server on %v stopped: %v", l.Addr(), err)
+		}
+	}()
+	logging.Infof("Serving health checks on %v", l.Addr())
+	return nil
+}
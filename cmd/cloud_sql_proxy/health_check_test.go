@@ -0,0 +1,69 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// fakeCertSource returns certificates for any instance without contacting the
+// Cloud SQL API.
+type fakeCertSource struct{}
+
+func (fakeCertSource) Local(instance string) (tls.Certificate, error) {
+	return tls.Certificate{
+		Leaf: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)},
+	}, nil
+}
+
+func (fakeCertSource) Remote(instance string) (*x509.Certificate, string, string, string, error) {
+	return &x509.Certificate{}, "127.0.0.1", instance, "POSTGRES_12", nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	c := &proxy.Client{Port: port, Certs: fakeCertSource{}}
+	h := healthCheckHandler(c)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if got := get(livenessPath); got != http.StatusOK {
+		t.Errorf("%s before any refresh: got %d, want %d", livenessPath, got, http.StatusOK)
+	}
+	if got := get(readinessPath); got != http.StatusServiceUnavailable {
+		t.Errorf("%s before any refresh: got %d, want %d", readinessPath, got, http.StatusServiceUnavailable)
+	}
+
+	if _, err := c.InstanceVersion("proj:region:instance"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := get(livenessPath); got != http.StatusOK {
+		t.Errorf("%s after refresh: got %d, want %d", livenessPath, got, http.StatusOK)
+	}
+	if got := get(readinessPath); got != http.StatusOK {
+		t.Errorf("%s after refresh: got %d, want %d", readinessPath, got, http.StatusOK)
+	}
+}
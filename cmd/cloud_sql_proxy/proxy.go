@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/fuse"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
@@ -158,8 +159,6 @@ func listenInstance(dst chan<- proxy.Conn, cfg instanceConfig) (net.Listener, er
 				l.Close()
 				return
 			}
-			logging.Verbosef("New connection for %q", cfg.Instance)
-
 			switch clientConn := c.(type) {
 			case *net.TCPConn:
 				clientConn.SetKeepAlive(true)
@@ -269,7 +268,11 @@ func parseInstanceConfig(dir, instance string, cl *http.Client) (instanceConfig,
 	if *host != "" {
 		sql.BasePath = *host
 	}
-	inst, err := sql.Instances.Get(proj, name).Do()
+	call := sql.Instances.Get(proj, name)
+	if *quotaProject != "" {
+		call.Header().Set(certs.QuotaProjectHeader, *quotaProject)
+	}
+	inst, err := call.Do()
 	if err != nil {
 		return instanceConfig{}, err
 	}
@@ -308,10 +311,12 @@ func parseTCPOpts(ntwk, addrOpt string) (string, error) {
 
 // parseInstanceConfigs calls parseInstanceConfig for each instance in the
 // provided slice, collecting errors along the way. There may be valid
-// instanceConfigs returned even if there's an error.
+// instanceConfigs returned even if there's an error. An instance listed more
+// than once is only returned with its first listen address.
 func parseInstanceConfigs(dir string, instances []string, cl *http.Client, skipFailedInstanceConfigs bool) ([]instanceConfig, error) {
 	errs := new(bytes.Buffer)
 	var cfg []instanceConfig
+	seen := make(map[string]instanceConfig)
 	for _, v := range instances {
 		if v == "" {
 			continue
@@ -323,7 +328,11 @@ func parseInstanceConfigs(dir string, instances []string, cl *http.Client, skipF
 				fmt.Fprintf(errs, "\n\t%v", err)
 			}
 
+		} else if first, ok := seen[c.Instance]; ok {
+			// One listener per instance is enough; keep the first mapping.
+			logging.Warningf("Ignoring duplicate instance configuration %q; %s is already served on %s %s", v, c.Instance, first.Network, first.Address)
 		} else {
+			seen[c.Instance] = c
 			cfg = append(cfg, c)
 		}
 	}
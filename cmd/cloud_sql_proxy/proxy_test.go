@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -199,3 +200,33 @@ func TestParseInstanceConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInstanceConfigsDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		instances []string
+		want      []string // listen addresses, in order
+	}{
+		{"identical tcp instances", []string{"proj:reg:x=tcp:1234", "proj:reg:x=tcp:1234"}, []string{"127.0.0.1:1234"}},
+		{"identical unix instances", []string{"proj:reg:x", "proj:reg:x"}, []string{"/x/proj:reg:x"}},
+		{"same instance on different ports", []string{"proj:reg:x=tcp:1234", "proj:reg:x=tcp:1235"}, []string{"127.0.0.1:1234"}},
+		{"same instance on tcp and unix", []string{"proj:reg:x", "proj:reg:x=tcp:1234"}, []string{"/x/proj:reg:x"}},
+		{"different instances", []string{"proj:reg:x=tcp:1234", "proj:reg:y=tcp:1235"}, []string{"127.0.0.1:1234", "127.0.0.1:1235"}},
+	} {
+		cfgs, err := parseInstanceConfigs("/x", tc.instances, mockClient, false)
+		if err != nil {
+			t.Errorf("%s: parseInstanceConfigs had unexpected error: %v", tc.desc, err)
+			continue
+		}
+		var got []string
+		for _, c := range cfgs {
+			got = append(got, c.Address)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got addresses %v (%+v), want %v", tc.desc, got, cfgs, tc.want)
+		}
+		if len(cfgs) > 0 && cfgs[0].Instance != "proj:reg:x" {
+			t.Errorf("%s: first config is for %q, want %q", tc.desc, cfgs[0].Instance, "proj:reg:x")
+		}
+	}
+}
@@ -13,13 +13,18 @@
 // limitations under the License.
 
 // Package logging contains helpers to support log messages. If you are using
-// the Cloud SQL Proxy as a Go library, you can override these variables to
-// control where log messages end up.
+// the Cloud SQL Proxy as a Go library, you can override these variables, or
+// provide your own Logger through SetLogger, to control where log messages end
+// up.
 package logging
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 // Verbosef is called to write verbose logs, such as when a new connection is
@@ -29,17 +34,242 @@ var Verbosef = log.Printf
 // Infof is called to write informational logs, such as when startup has
 var Infof = log.Printf
 
+// Warningf is called to write a warning log, such as when a deprecated
+// configuration is used.
+var Warningf = log.Printf
+
 // Errorf is called to write an error log, such as when a new connection fails.
 var Errorf = log.Printf
 
+// Level controls which log messages are written; see SetLevel.
+type Level int
+
+// Levels in order of increasing verbosity. Each level includes the messages of
+// the levels before it.
+const (
+	LevelError Level = iota
+	LevelWarning
+	LevelInfo
+	LevelVerbose
+)
+
+var severities = map[Level]string{
+	LevelError:   "ERROR",
+	LevelWarning: "WARNING",
+	LevelInfo:    "INFO",
+	LevelVerbose: "DEBUG",
+}
+
+// Logger is implemented by custom loggers that should receive the proxy's log
+// messages; see SetLogger.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+var (
+	// The settings below are recorded so that each helper can rebuild the
+	// log functions without undoing the effect of the others.
+	debugToStdout    bool
+	verboseToNowhere bool
+	jsonFormat       bool
+	level            = LevelVerbose
+	logger           Logger
+
+	// jsonMu serializes writes of JSON log entries.
+	jsonMu sync.Mutex
+)
+
 // LogDebugToStdout updates Verbosef and Info logging to use stdout instead of stderr.
 func LogDebugToStdout() {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	Verbosef = logger.Printf
-	Infof = logger.Printf
+	debugToStdout = true
+	Verbosef = logf(LevelVerbose)
+	Infof = logf(LevelInfo)
 }
 
 // LogVerboseToNowhere updates Verbosef so verbose log messages are discarded
 func LogVerboseToNowhere() {
-	Verbosef = func(string, ...interface{}) {}
+	verboseToNowhere = true
+	Verbosef = logf(LevelVerbose)
+}
+
+// SetJSON toggles structured logging. When enabled, all log functions write
+// every message as a single-line JSON object with "severity", "message" and
+// "timestamp" keys, plus any Fields attached through WithFields, which Cloud
+// Logging and most log pipelines can parse directly. Disabling it restores
+// the default text format.
+func SetJSON(enabled bool) {
+	jsonFormat = enabled
+	resetAll()
+}
+
+// SetLevel discards messages that are more verbose than l. For example,
+// SetLevel(LevelError) keeps only Errorf output. The default is LevelVerbose.
+func SetLevel(l Level) {
+	level = l
+	resetAll()
+}
+
+// SetLogger routes all log messages to l instead of the standard logger, which
+// lets library users integrate the proxy's messages with their own logging.
+// Verbose messages go to l's Verbosef method if it has one, and to l.Infof
+// otherwise. SetLevel and LogVerboseToNowhere still apply; the output settings
+// (SetJSON, LogDebugToStdout) do not. Passing nil restores the default output.
+func SetLogger(l Logger) {
+	logger = l
+	resetAll()
+}
+
+func resetAll() {
+	Verbosef = logf(LevelVerbose)
+	Infof = logf(LevelInfo)
+	Warningf = logf(LevelWarning)
+	Errorf = logf(LevelError)
+}
+
+// enabled reports whether messages of level l are written.
+func enabled(l Level) bool {
+	return l <= level && !(l == LevelVerbose && verboseToNowhere)
+}
+
+// logf returns the log function for messages of level l given the current
+// settings.
+func logf(l Level) func(string, ...interface{}) {
+	if !enabled(l) {
+		return func(string, ...interface{}) {}
+	}
+	if logger != nil {
+		return loggerFunc(logger, l)
+	}
+	// Only verbose and informational messages are redirected to stdout.
+	stdout := debugToStdout && l >= LevelInfo
+	if jsonFormat {
+		severity := severities[l]
+		return func(format string, v ...interface{}) {
+			writeJSON(severity, stdout, fmt.Sprintf(format, v...), nil)
+		}
+	}
+	if stdout {
+		return log.New(os.Stdout, "", log.LstdFlags).Printf
+	}
+	return log.Printf
+}
+
+// loggerFunc returns the method of the custom logger lg handling level l.
+func loggerFunc(lg Logger, l Level) func(string, ...interface{}) {
+	switch l {
+	case LevelError:
+		return lg.Errorf
+	case LevelWarning:
+		return lg.Warningf
+	case LevelVerbose:
+		if v, ok := lg.(interface {
+			Verbosef(format string, v ...interface{})
+		}); ok {
+			return v.Verbosef
+		}
+	}
+	return lg.Infof
+}
+
+type jsonEntry struct {
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+}
+
+func writeJSON(severity string, stdout bool, msg string, fields Fields) {
+	entry := jsonEntry{
+		Severity:  severity,
+		Message:   msg,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	// Marshaling a struct of strings cannot fail.
+	b, _ := json.Marshal(entry)
+	if len(fields) > 0 {
+		m := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			m[k] = v
+		}
+		m["severity"], m["message"], m["timestamp"] = entry.Severity, entry.Message, entry.Timestamp
+		// Fields that cannot be marshaled are dropped rather than losing the
+		// message.
+		if withFields, err := json.Marshal(m); err == nil {
+			b = withFields
+		}
+	}
+	b = append(b, '\n')
+
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	// Resolve the writer on every call so that log.SetOutput (as used by
+	// -quiet) keeps working after SetJSON.
+	if stdout {
+		os.Stdout.Write(b)
+	} else {
+		log.Writer().Write(b)
+	}
+}
+
+// Fields are structured values attached to log messages by a FieldLogger.
+type Fields map[string]interface{}
+
+// FieldLogger writes log messages with a fixed set of Fields attached. In JSON
+// mode the fields are added as keys of each entry. Otherwise, or when a custom
+// Logger is set, messages go to the package-level functions and the fields are
+// not written.
+type FieldLogger struct {
+	fields Fields
+	logger Logger
+}
+
+// WithFields returns a FieldLogger that attaches f to every message.
+func WithFields(f Fields) FieldLogger {
+	return FieldLogger{fields: f}
+}
+
+// WithLogger returns a copy of l that sends its messages to lg, in the same
+// way as SetLogger but for l alone, which lets one user of the proxy log
+// separately from the rest of the program. The fields are not written. If lg
+// is nil, the copy uses the package-level functions.
+func (l FieldLogger) WithLogger(lg Logger) FieldLogger {
+	l.logger = lg
+	return l
+}
+
+// Verbosef writes a verbose message with l's fields.
+func (l FieldLogger) Verbosef(format string, v ...interface{}) {
+	l.logf(LevelVerbose, Verbosef, format, v)
+}
+
+// Infof writes an informational message with l's fields.
+func (l FieldLogger) Infof(format string, v ...interface{}) {
+	l.logf(LevelInfo, Infof, format, v)
+}
+
+// Warningf writes a warning message with l's fields.
+func (l FieldLogger) Warningf(format string, v ...interface{}) {
+	l.logf(LevelWarning, Warningf, format, v)
+}
+
+// Errorf writes an error message with l's fields.
+func (l FieldLogger) Errorf(format string, v ...interface{}) {
+	l.logf(LevelError, Errorf, format, v)
+}
+
+func (l FieldLogger) logf(lvl Level, text func(string, ...interface{}), format string, v []interface{}) {
+	if l.logger != nil {
+		if enabled(lvl) {
+			loggerFunc(l.logger, lvl)(format, v...)
+		}
+		return
+	}
+	if !jsonFormat || logger != nil || len(l.fields) == 0 {
+		text(format, v...)
+		return
+	}
+	if enabled(lvl) {
+		writeJSON(severities[lvl], debugToStdout && lvl >= LevelInfo, fmt.Sprintf(format, v...), l.fields)
+	}
 }
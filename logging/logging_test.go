@@ -0,0 +1,247 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog redirects the standard logger into a buffer. The returned func
+// restores the standard logger and the package state.
+func captureLog() (*bytes.Buffer, func()) {
+	buf := new(bytes.Buffer)
+	flags := log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	return buf, func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		debugToStdout, verboseToNowhere, jsonFormat, logger = false, false, false, nil
+		SetLevel(LevelVerbose)
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	Infof("hello %s", "world")
+	Errorf("failed: %d", 42)
+
+	want := "hello world\nfailed: 42\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected text output: got %q, want %q", got, want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	SetJSON(true)
+
+	Verbosef("verbose %v", 1)
+	Infof("hello %s", "world")
+	Errorf("failed: %q", "quoted")
+
+	wants := []struct{ severity, message string }{
+		{"DEBUG", "verbose 1"},
+		{"INFO", "hello world"},
+		{"ERROR", `failed: "quoted"`},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(wants) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(wants), buf.String())
+	}
+	for i, want := range wants {
+		var got jsonEntry
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil {
+			t.Fatalf("line %d is not valid JSON (%q): %v", i, lines[i], err)
+		}
+		if got.Severity != want.severity || got.Message != want.message {
+			t.Errorf("line %d: got (%q, %q), want (%q, %q)", i, got.Severity, got.Message, want.severity, want.message)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got.Timestamp); err != nil {
+			t.Errorf("line %d: invalid timestamp %q: %v", i, got.Timestamp, err)
+		}
+	}
+}
+
+func TestJSONRespectsVerboseToNowhere(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	LogVerboseToNowhere()
+	SetJSON(true)
+
+	Verbosef("should not appear")
+	if buf.Len() != 0 {
+		t.Errorf("verbose output was not discarded: %q", buf.String())
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	for _, tc := range []struct {
+		level Level
+		want  string
+	}{
+		{LevelError, "error\n"},
+		{LevelWarning, "warning\nerror\n"},
+		{LevelInfo, "info\nwarning\nerror\n"},
+		{LevelVerbose, "verbose\ninfo\nwarning\nerror\n"},
+	} {
+		buf.Reset()
+		SetLevel(tc.level)
+
+		Verbosef("verbose")
+		Infof("info")
+		Warningf("warning")
+		Errorf("error")
+
+		if got := buf.String(); got != tc.want {
+			t.Errorf("SetLevel(%v): got %q, want %q", tc.level, got, tc.want)
+		}
+	}
+}
+
+// capturingLogger records messages prefixed by the method that received them.
+type capturingLogger struct {
+	msgs []string
+}
+
+func (c *capturingLogger) Infof(format string, v ...interface{}) {
+	c.msgs = append(c.msgs, "info: "+fmt.Sprintf(format, v...))
+}
+
+func (c *capturingLogger) Warningf(format string, v ...interface{}) {
+	c.msgs = append(c.msgs, "warning: "+fmt.Sprintf(format, v...))
+}
+
+func (c *capturingLogger) Errorf(format string, v ...interface{}) {
+	c.msgs = append(c.msgs, "error: "+fmt.Sprintf(format, v...))
+}
+
+type capturingVerboseLogger struct {
+	capturingLogger
+}
+
+func (c *capturingVerboseLogger) Verbosef(format string, v ...interface{}) {
+	c.msgs = append(c.msgs, "verbose: "+fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	logAll := func() {
+		Verbosef("v%d", 1)
+		Infof("i%d", 2)
+		Warningf("w%d", 3)
+		Errorf("e%d", 4)
+	}
+
+	l := &capturingLogger{}
+	SetLogger(l)
+	logAll()
+	want := []string{"info: v1", "info: i2", "warning: w3", "error: e4"}
+	if fmt.Sprint(l.msgs) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", l.msgs, want)
+	}
+
+	vl := &capturingVerboseLogger{}
+	SetLogger(vl)
+	SetLevel(LevelWarning)
+	logAll()
+	SetLevel(LevelVerbose)
+	Verbosef("v%d", 5)
+	want = []string{"warning: w3", "error: e4", "verbose: v5"}
+	if fmt.Sprint(vl.msgs) != fmt.Sprint(want) {
+		t.Errorf("with Verbosef: got %q, want %q", vl.msgs, want)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("standard logger received output: %q", buf.String())
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	l := WithFields(Fields{"instance": "proj:region:db", "connection": 7})
+
+	l.Infof("text %d", 1)
+	if got, want := buf.String(), "text 1\n"; got != want {
+		t.Errorf("text format: got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	SetJSON(true)
+	l.Warningf("json %d", 2)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON (%q): %v", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"severity":   "WARNING",
+		"message":    "json 2",
+		"instance":   "proj:region:db",
+		"connection": 7.0,
+	} {
+		if got[k] != want {
+			t.Errorf("key %q: got %v, want %v", k, got[k], want)
+		}
+	}
+
+	buf.Reset()
+	SetLevel(LevelError)
+	l.Infof("filtered")
+	if buf.Len() != 0 {
+		t.Errorf("message above the level was written: %q", buf.String())
+	}
+}
+
+func TestFieldLoggerWithLogger(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	SetJSON(true)
+	base := WithFields(Fields{"instance": "proj:region:db"})
+
+	vl := &capturingVerboseLogger{}
+	l := base.WithLogger(vl)
+	l.Verbosef("v%d", 1)
+	l.Errorf("e%d", 2)
+	SetLevel(LevelWarning)
+	l.Infof("filtered")
+	want := []string{"verbose: v1", "error: e2"}
+	if fmt.Sprint(vl.msgs) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", vl.msgs, want)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("standard logger received output: %q", buf.String())
+	}
+
+	base.WithLogger(nil).Warningf("default")
+	if !strings.Contains(buf.String(), `"message":"default"`) {
+		t.Errorf("WithLogger(nil) did not use the default output: %q", buf.String())
+	}
+}
@@ -35,7 +35,13 @@ import (
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
-const defaultUserAgent = "custom cloud_sql_proxy version >= 1.10"
+const (
+	defaultUserAgent = "custom cloud_sql_proxy version >= 1.10"
+
+	// QuotaProjectHeader is the header used to select the project that is
+	// billed for, and whose quota is used by, Admin API requests.
+	QuotaProjectHeader = "X-Goog-User-Project"
+)
 
 // NewCertSource returns a CertSource which can be used to authenticate using
 // the provided client, which must not be nil.
@@ -68,6 +74,11 @@ type RemoteOpts struct {
 
 	// IP address type options
 	IPAddrTypeOpts []string
+
+	// QuotaProject, if set, is the project used for quota and billing of the
+	// sqladmin API requests. This is needed when authenticating with user
+	// credentials, which have no project of their own.
+	QuotaProject string
 }
 
 // NewCertSourceOpts returns a CertSource configured with the provided Opts.
@@ -105,7 +116,7 @@ func NewCertSourceOpts(c *http.Client, opts RemoteOpts) *RemoteCertSource {
 		}
 	}
 
-	return &RemoteCertSource{pkey, serv, !opts.IgnoreRegion, opts.IPAddrTypeOpts}
+	return &RemoteCertSource{pkey, serv, !opts.IgnoreRegion, opts.IPAddrTypeOpts, opts.QuotaProject}
 }
 
 // RemoteCertSource implements a CertSource, using Cloud SQL APIs to
@@ -123,6 +134,16 @@ type RemoteCertSource struct {
 	checkRegion bool
 	// a list of ip address types that users select
 	IPAddrTypes []string
+	// If set, sent as the QuotaProjectHeader on every API request.
+	quotaProject string
+}
+
+// setQuotaProject adds the quota project header, if configured, to an API
+// request's headers.
+func (s *RemoteCertSource) setQuotaProject(h http.Header) {
+	if s.quotaProject != "" {
+		h.Set(QuotaProjectHeader, s.quotaProject)
+	}
 }
 
 // Constants for backoffAPIRetry. These cause the retry logic to scale the
@@ -175,6 +196,7 @@ func (s *RemoteCertSource) Local(instance string) (ret tls.Certificate, err erro
 			PublicKey: string(pem.EncodeToMemory(&pem.Block{Bytes: pkix, Type: "RSA PUBLIC KEY"})),
 		},
 	)
+	s.setQuotaProject(req.Header())
 
 	var data *sqladmin.SslCert
 	err = backoffAPIRetry("createEphemeral for", instance, func() error {
@@ -229,6 +251,7 @@ func (s *RemoteCertSource) findIPAddr(data *sqladmin.DatabaseInstance, instance
 func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error) {
 	p, region, n := util.SplitName(instance)
 	req := s.serv.Instances.Get(p, n)
+	s.setQuotaProject(req.Header())
 
 	var data *sqladmin.DatabaseInstance
 	err = backoffAPIRetry("get instance", instance, func() error {
@@ -0,0 +1,153 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+const instance = "proj:region:my-db"
+
+// selfSignedPEM returns a PEM-encoded self-signed certificate.
+func selfSignedPEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: instance},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// fakeAdminAPI pretends to be the Cloud SQL Admin API for a single instance
+// and records the requests it receives.
+type fakeAdminAPI struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func newFakeAdminAPI(t *testing.T) *fakeAdminAPI {
+	cert := selfSignedPEM(t)
+	f := &fakeAdminAPI{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.reqs = append(f.reqs, r)
+		f.mu.Unlock()
+
+		var resp interface{}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/createEphemeral"):
+			resp = &sqladmin.SslCert{Cert: cert}
+		case strings.HasSuffix(r.URL.Path, "/instances/my-db"):
+			resp = &sqladmin.DatabaseInstance{
+				BackendType:     "SECOND_GEN",
+				DatabaseVersion: "POSTGRES_12",
+				Region:          "region",
+				IpAddresses:     []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "127.0.0.1"}},
+				ServerCaCert:    &sqladmin.SslCert{Cert: cert},
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return f
+}
+
+func (f *fakeAdminAPI) requests() []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Request(nil), f.reqs...)
+}
+
+func TestAPIBasePath(t *testing.T) {
+	api := newFakeAdminAPI(t)
+	defer api.Close()
+
+	src := NewCertSourceOpts(http.DefaultClient, RemoteOpts{APIBasePath: api.URL + "/"})
+	if _, err := src.Local(instance); err != nil {
+		t.Fatalf("Local(%q): %v", instance, err)
+	}
+	_, addr, name, version, err := src.Remote(instance)
+	if err != nil {
+		t.Fatalf("Remote(%q): %v", instance, err)
+	}
+	if addr != "127.0.0.1" || name != "proj:my-db" || version != "POSTGRES_12" {
+		t.Errorf("Remote(%q) = (%q, %q, %q), want (%q, %q, %q)", instance, addr, name, version, "127.0.0.1", "proj:my-db", "POSTGRES_12")
+	}
+
+	wantPaths := []string{
+		"/sql/v1beta4/projects/proj/instances/my-db/createEphemeral",
+		"/sql/v1beta4/projects/proj/instances/my-db",
+	}
+	reqs := api.requests()
+	if len(reqs) != len(wantPaths) {
+		t.Fatalf("override endpoint got %d requests, want %d", len(reqs), len(wantPaths))
+	}
+	for i, want := range wantPaths {
+		if got := reqs[i].URL.Path; got != want {
+			t.Errorf("request %d: got path %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestQuotaProject(t *testing.T) {
+	for _, quotaProject := range []string{"", "billing-project"} {
+		api := newFakeAdminAPI(t)
+
+		src := NewCertSourceOpts(http.DefaultClient, RemoteOpts{
+			APIBasePath:  api.URL + "/",
+			QuotaProject: quotaProject,
+		})
+		if _, err := src.Local(instance); err != nil {
+			t.Fatalf("Local(%q): %v", instance, err)
+		}
+		if _, _, _, _, err := src.Remote(instance); err != nil {
+			t.Fatalf("Remote(%q): %v", instance, err)
+		}
+
+		for _, r := range api.requests() {
+			if got := r.Header.Get(QuotaProjectHeader); got != quotaProject {
+				t.Errorf("QuotaProject %q: request to %v had %s %q", quotaProject, r.URL.Path, QuotaProjectHeader, got)
+			}
+		}
+		api.Close()
+	}
+}
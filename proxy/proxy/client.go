@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,6 +32,10 @@ import (
 const (
 	DefaultRefreshCfgThrottle = time.Minute
 	keepAlivePeriod           = time.Minute
+
+	// DefaultSlowRefreshThreshold is used when Client.SlowRefreshThreshold
+	// is not set.
+	DefaultSlowRefreshThreshold = 5 * time.Second
 )
 
 var (
@@ -39,6 +44,14 @@ var (
 	// user.
 	errNotCached      = errors.New("instance was not found in cache")
 	refreshCertBuffer = 30 * time.Second
+
+	// ErrTooManyConnections is wrapped by the error passed to Client.OnError
+	// when a connection is refused because of Client.MaxConnections.
+	ErrTooManyConnections = errors.New("too many open connections")
+
+	// lastConnID is incremented atomically to give each connection handled by
+	// a Client a number that ties its log lines together.
+	lastConnID uint64
 )
 
 // Conn represents a connection from a client to a specific instance.
@@ -47,6 +60,30 @@ type Conn struct {
 	Conn     net.Conn
 }
 
+// TunnelStats describes a connection proxied by a Client once it has closed.
+type TunnelStats struct {
+	// Instance is the instance the connection was proxied to.
+	Instance string
+	// ID is the number identifying the connection in log messages.
+	ID uint64
+	// ClientAddr and LocalAddr are the remote and local addresses of the
+	// client's connection to the proxy.
+	ClientAddr, LocalAddr net.Addr
+	// Start is when the connection to the instance was established, and
+	// Duration is how long it stayed open.
+	Start    time.Time
+	Duration time.Duration
+	// BytesUp is the number of bytes sent from the client to the instance,
+	// and BytesDown the number sent from the instance to the client.
+	BytesUp, BytesDown uint64
+	// ClosedBy is "client" or "instance" for the side whose read or write
+	// ended the connection, or "proxy" if a timeout closed it.
+	ClosedBy string
+	// Err is the error that ended the connection. It is nil if the side
+	// named by ClosedBy closed the connection cleanly.
+	Err error
+}
+
 // CertSource is how a Client obtains various certificates required for operation.
 type CertSource interface {
 	// Local returns a certificate that can be used to authenticate with the
@@ -80,6 +117,12 @@ type Client struct {
 	// malfunction.
 	RefreshCfgThrottle time.Duration
 
+	// SlowRefreshThreshold is how long fetching an instance's certificates
+	// and address from the Cloud SQL API may take before a warning is
+	// logged. If not set, it defaults to 5 seconds; a negative value
+	// disables the warning.
+	SlowRefreshThreshold time.Duration
+
 	// The cfgCache holds the most recent connection configuration keyed by
 	// instance. Relevant functions are refreshCfg and cachedCfg. It is
 	// protected by cacheL.
@@ -95,6 +138,83 @@ type Client struct {
 
 	// ConnectionsCounter is used to enforce the optional maxConnections limit
 	ConnectionsCounter uint64
+
+	// AllowedInstances, if not empty, restricts which instances connections
+	// may be proxied to. Entries are either a full instance connection name or
+	// "project:region:*", which allows every instance in that region.
+	// Connections to other instances are closed without being dialed.
+	AllowedInstances []string
+
+	// IdleTimeout, if set, closes connections on which no data has been sent
+	// in either direction for this long. 0 means no timeout.
+	IdleTimeout time.Duration
+
+	// MaxConnAge, if set, closes connections this long after they were
+	// opened, even if they are in use, so that clients must reconnect. 0
+	// means no limit.
+	MaxConnAge time.Duration
+
+	// AccessLog, if true, logs one line at info level when each connection
+	// closes, recording the fields of its TunnelStats.
+	AccessLog bool
+
+	// OnClose, if not nil, is called exactly once for each proxied connection
+	// after it has closed. It is called synchronously while the connection is
+	// torn down, so it should return quickly.
+	OnClose func(TunnelStats)
+
+	// OnError, if not nil, is called with the instance and the error each
+	// time a connection cannot be proxied: when dialing the instance fails,
+	// or when MaxConnections is exceeded (the error then wraps
+	// ErrTooManyConnections). The errors are logged either way. OnError may be
+	// called concurrently from several connections.
+	OnError func(instance string, err error)
+
+	// Logger, if not nil, receives the log messages about individual
+	// connections, such as connection errors and access log lines, instead of
+	// the logging package's functions or the logger set with
+	// logging.SetLogger. logging.SetLevel still applies.
+	Logger logging.Logger
+
+	// BufferSize is the size in bytes of the buffer used to copy data in each
+	// direction of a connection. Larger buffers can help with bulk transfers.
+	// If not set, it defaults to 16 KiB.
+	BufferSize int
+
+	// DrainTimeout, if set, is how long to keep forwarding data from the
+	// instance after the client has closed its side of a connection, so that
+	// the end of a response is not lost. 0 closes the connection immediately.
+	DrainTimeout time.Duration
+
+	// WriteTimeout, if set, closes a connection when forwarding data from the
+	// instance to the client has not completed within this long, for example
+	// because the client stopped reading. 0 means no timeout.
+	WriteTimeout time.Duration
+
+	// InitialReadTimeout, if set, closes connections on which the client has
+	// sent no data this long after the connection to the instance was
+	// established. With protocols where the server speaks first, such as
+	// MySQL's, this must allow for the initial handshake. 0 means no timeout.
+	InitialReadTimeout time.Duration
+
+	// MinTLSVersion is the minimum TLS version, such as tls.VersionTLS13, used
+	// for connections to instances. If not set, the crypto/tls default is used.
+	MinTLSVersion uint16
+	// CipherSuites, if not empty, restricts the cipher suites offered for
+	// TLS 1.2 and earlier connections to instances. TLS 1.3 suites are not
+	// configurable.
+	CipherSuites []uint16
+
+	// TLSConfigFunc, if not nil, is called with each new TLS configuration for
+	// connecting to an instance and returns the configuration to use, for
+	// example to trust the certificate of a local emulator. It receives a
+	// config of its own, which it may modify and return.
+	//
+	// The config passed in verifies the instance's certificate against the CA
+	// returned by the Cloud SQL Admin API. Replacing RootCAs or
+	// VerifyPeerCertificate, or clearing the latter while InsecureSkipVerify
+	// is set, disables that check, so connections can then be intercepted.
+	TLSConfigFunc func(*tls.Config) *tls.Config
 }
 
 type cacheEntry struct {
@@ -119,20 +239,33 @@ func (c *Client) Run(connSrc <-chan Conn) {
 }
 
 func (c *Client) handleConn(conn Conn) {
+	// tag identifies this connection in every log line it produces.
+	id := atomic.AddUint64(&lastConnID, 1)
+	tag := fmt.Sprintf("(connection %d)", id)
+	logger := logging.WithFields(logging.Fields{"instance": conn.Instance, "connection": id}).WithLogger(c.Logger)
+
+	if !c.instanceAllowed(conn.Instance) {
+		logger.Warningf("rejecting connection to %q %s: instance is not allowed", conn.Instance, tag)
+		conn.Conn.Close()
+		return
+	}
+
 	active := atomic.AddUint64(&c.ConnectionsCounter, 1)
 
 	// Deferred decrement of ConnectionsCounter upon connection closing
 	defer atomic.AddUint64(&c.ConnectionsCounter, ^uint64(0))
 
 	if c.MaxConnections > 0 && active > c.MaxConnections {
-		logging.Errorf("too many open connections (max %d)", c.MaxConnections)
+		logger.Errorf("too many open connections (max %d), closing %s", c.MaxConnections, tag)
+		c.reportError(conn.Instance, fmt.Errorf("%w (max %d)", ErrTooManyConnections, c.MaxConnections))
 		conn.Conn.Close()
 		return
 	}
 
 	server, err := c.Dial(conn.Instance)
 	if err != nil {
-		logging.Errorf("couldn't connect to %q: %v", conn.Instance, err)
+		logger.Errorf("couldn't connect to %q %s: %v", conn.Instance, tag, err)
+		c.reportError(conn.Instance, err)
 		conn.Conn.Close()
 		return
 	}
@@ -143,14 +276,88 @@ func (c *Client) handleConn(conn Conn) {
 		conn.Conn = dbgConn{conn.Conn}
 	}
 
+	remoteDesc := conn.Instance + " " + tag
+	localDesc := "local connection on " + conn.Conn.LocalAddr().String() + " " + tag
+	logger.Verbosef("Opened %v to %q", localDesc, conn.Instance)
+
+	opts := tunnelOpts{
+		idleTimeout:        c.IdleTimeout,
+		maxAge:             c.MaxConnAge,
+		bufferSize:         c.BufferSize,
+		drainTimeout:       c.DrainTimeout,
+		writeTimeout:       c.WriteTimeout,
+		initialReadTimeout: c.InitialReadTimeout,
+	}
+	if c.AccessLog || c.OnClose != nil {
+		start := time.Now()
+		opts.onClose = func(closer string, err error, up, down uint64) {
+			s := TunnelStats{
+				Instance:   conn.Instance,
+				ID:         id,
+				ClientAddr: conn.Conn.RemoteAddr(),
+				LocalAddr:  conn.Conn.LocalAddr(),
+				Start:      start,
+				Duration:   time.Since(start),
+				BytesUp:    up,
+				BytesDown:  down,
+				ClosedBy:   closer,
+				Err:        err,
+			}
+			if c.AccessLog {
+				logAccess(logger, s)
+			}
+			if c.OnClose != nil {
+				c.OnClose(s)
+			}
+		}
+	}
+
+	metrics.Add("total_tunnels", 1)
+	metrics.Add("active_tunnels", 1)
+	defer metrics.Add("active_tunnels", -1)
+
 	c.Conns.Add(conn.Instance, conn.Conn)
-	copyThenClose(server, conn.Conn, conn.Instance, "local connection on "+conn.Conn.LocalAddr().String())
+	copyThenClose(server, conn.Conn, remoteDesc, localDesc, logger, opts)
 
 	if err := c.Conns.Remove(conn.Instance, conn.Conn); err != nil {
-		logging.Errorf("%s", err)
+		logger.Errorf("%s", err)
 	}
 }
 
+// reportError passes err to OnError, if set.
+func (c *Client) reportError(instance string, err error) {
+	if c.OnError != nil {
+		c.OnError(instance, err)
+	}
+}
+
+// logAccess writes the access log line for a closed tunnel.
+func logAccess(logger connLogger, s TunnelStats) {
+	var errMsg string
+	if s.Err != nil {
+		errMsg = s.Err.Error()
+	}
+	logger.Infof("access: connection=%d instance=%q client=%v local=%v start=%s duration=%v bytes_up=%d bytes_down=%d closer=%q error=%q",
+		s.ID, s.Instance, s.ClientAddr, s.LocalAddr, s.Start.UTC().Format(time.RFC3339Nano), s.Duration, s.BytesUp, s.BytesDown, s.ClosedBy, errMsg)
+}
+
+// instanceAllowed reports whether AllowedInstances permits connecting to
+// instance.
+func (c *Client) instanceAllowed(instance string) bool {
+	if len(c.AllowedInstances) == 0 {
+		return true
+	}
+	for _, a := range c.AllowedInstances {
+		if a == instance {
+			return true
+		}
+		if strings.HasSuffix(a, ":*") && strings.HasPrefix(instance, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
 // refreshCfg uses the CertSource inside the Client to find the instance's
 // address as well as construct a new tls.Config to connect to the instance. It
 // caches the result.
@@ -187,12 +394,15 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 		c.cacheL.Unlock()
 	}()
 
+	start := time.Now()
 	mycert, err := c.Certs.Local(instance)
 	if err != nil {
+		c.warnIfSlow(instance, start)
 		return "", nil, "", err
 	}
 
 	scert, addr, name, version, err := c.Certs.Remote(instance)
+	c.warnIfSlow(instance, start)
 	if err != nil {
 		return "", nil, "", err
 	}
@@ -212,6 +422,13 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 		// that will verify that the certificate is OK.
 		InsecureSkipVerify:    true,
 		VerifyPeerCertificate: genVerifyPeerCertificateFunc(name, certs),
+		MinVersion:            c.MinTLSVersion,
+		CipherSuites:          c.CipherSuites,
+	}
+	if c.TLSConfigFunc != nil {
+		if cfg = c.TLSConfigFunc(cfg); cfg == nil {
+			return "", nil, "", fmt.Errorf("TLSConfigFunc returned a nil config for instance %q", instance)
+		}
 	}
 
 	expire := mycert.Leaf.NotAfter
@@ -227,6 +444,18 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 	return fmt.Sprintf("%s:%d", addr, c.Port), cfg, version, nil
 }
 
+// warnIfSlow logs a warning if the Cloud SQL API calls for instance, started
+// at start, took longer than SlowRefreshThreshold.
+func (c *Client) warnIfSlow(instance string, start time.Time) {
+	threshold := c.SlowRefreshThreshold
+	if threshold == 0 {
+		threshold = DefaultSlowRefreshThreshold
+	}
+	if elapsed := time.Since(start); threshold > 0 && elapsed > threshold {
+		logging.Warningf("Refreshing the configuration for %q took %v (threshold %v)", instance, elapsed, threshold)
+	}
+}
+
 // refreshCertAfter refreshes the epehemeral certificate of the instance after timeToRefresh.
 func (c *Client) refreshCertAfter(instance string, timeToRefresh time.Duration) {
 	<-time.After(timeToRefresh)
@@ -278,12 +507,30 @@ func (c *Client) cachedCfg(instance string) (string, *tls.Config, string) {
 	return ret.addr, ret.cfg, ret.version
 }
 
+// ValidCachedInstances returns the instances for which the client currently
+// holds a valid, unexpired configuration. It never contacts the Cloud SQL API.
+func (c *Client) ValidCachedInstances() []string {
+	c.cacheL.RLock()
+	defer c.cacheL.RUnlock()
+
+	var ret []string
+	for instance, e := range c.cfgCache {
+		if e.err == nil && !isExpired(e.cfg) {
+			ret = append(ret, instance)
+		}
+	}
+	return ret
+}
+
 // Dial uses the configuration stored in the client to connect to an instance.
 // If this func returns a nil error the connection is correctly authenticated
 // to connect to the instance.
+//
+// Returned errors name the instance (and address, once it is known) and wrap
+// the underlying error, so errors.Is and errors.As can inspect it.
 func (c *Client) Dial(instance string) (net.Conn, error) {
 	if addr, cfg, _ := c.cachedCfg(instance); cfg != nil {
-		ret, err := c.tryConnect(addr, cfg)
+		ret, err := c.tryConnect(instance, addr, cfg)
 		if err == nil {
 			return ret, err
 		}
@@ -291,19 +538,19 @@ func (c *Client) Dial(instance string) (net.Conn, error) {
 
 	addr, cfg, _, err := c.refreshCfg(instance)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("refreshing configuration for instance %q: %w", instance, err)
 	}
-	return c.tryConnect(addr, cfg)
+	return c.tryConnect(instance, addr, cfg)
 }
 
-func (c *Client) tryConnect(addr string, cfg *tls.Config) (net.Conn, error) {
+func (c *Client) tryConnect(instance, addr string, cfg *tls.Config) (net.Conn, error) {
 	d := c.Dialer
 	if d == nil {
 		d = proxy.FromEnvironment().Dial
 	}
 	conn, err := d("tcp", addr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("dialing instance %q (%s): %w", instance, addr, err)
 	}
 	type setKeepAliver interface {
 		SetKeepAlive(keepalive bool) error
@@ -323,7 +570,7 @@ func (c *Client) tryConnect(addr string, cfg *tls.Config) (net.Conn, error) {
 	ret := tls.Client(conn, cfg)
 	if err := ret.Handshake(); err != nil {
 		ret.Close()
-		return nil, err
+		return nil, fmt.Errorf("TLS handshake with instance %q (%s): %w", instance, addr, err)
 	}
 	return ret, nil
 }
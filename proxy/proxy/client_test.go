@@ -15,15 +15,32 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 )
 
 const instance = "instance-name"
@@ -64,6 +81,105 @@ func (cs *blockingCertSource) Remote(instance string) (cert *x509.Certificate, a
 	return &x509.Certificate{}, "fake address", "fake name", "fake version", nil
 }
 
+// failingCertSource returns err from every call.
+type failingCertSource struct {
+	err error
+}
+
+func (cs *failingCertSource) Local(instance string) (tls.Certificate, error) {
+	return tls.Certificate{}, cs.err
+}
+
+func (cs *failingCertSource) Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error) {
+	return nil, "", "", "", cs.err
+}
+
+// slowCertSource wraps another CertSource, sleeping before every call to
+// Remote.
+type slowCertSource struct {
+	CertSource
+	delay time.Duration
+}
+
+func (cs *slowCertSource) Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error) {
+	time.Sleep(cs.delay)
+	return cs.CertSource.Remote(instance)
+}
+
+// tlsCertSource hands out a self-signed server certificate so that Dial can
+// complete a real TLS handshake against a server run by the test.
+type tlsCertSource struct {
+	server *x509.Certificate
+}
+
+func (cs *tlsCertSource) Local(instance string) (tls.Certificate, error) {
+	return tls.Certificate{Leaf: &x509.Certificate{NotAfter: forever}}, nil
+}
+
+func (cs *tlsCertSource) Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error) {
+	return cs.server, "fake address", "fake name", "fake version", nil
+}
+
+// newTLSClient returns a Client whose Dialer connects to in-memory TLS
+// servers configured by serverCfg, which may be nil. The server end of each
+// dialed connection is sent on the returned channel once its handshake
+// completes.
+func newTLSClient(t *testing.T, serverCfg *tls.Config) (*Client, <-chan net.Conn) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake name"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{}
+	if serverCfg != nil {
+		cfg = serverCfg.Clone()
+	}
+	cfg.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}}
+
+	servers := make(chan net.Conn, 1)
+	c := &Client{
+		Certs: &tlsCertSource{leaf},
+		Dialer: func(string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				s := tls.Server(server, cfg)
+				if err := s.Handshake(); err != nil {
+					t.Errorf("server handshake failed: %v", err)
+					return
+				}
+				servers <- s
+			}()
+			return client, nil
+		},
+	}
+	return c, servers
+}
+
+// captureLog redirects the standard logger, which the logging package writes
+// to by default, until the returned func is called.
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	return &buf, func() { log.SetOutput(os.Stderr) }
+}
+
 func TestClientCache(t *testing.T) {
 	b := &fakeCerts{}
 	c := &Client{
@@ -79,7 +195,7 @@ func TestClientCache(t *testing.T) {
 	}
 
 	for i := 0; i < 5; i++ {
-		if _, err := c.Dial(instance); err != errFakeDial {
+		if _, err := c.Dial(instance); !errors.Is(err, errFakeDial) {
 			t.Errorf("unexpected error: %v", err)
 		}
 	}
@@ -120,7 +236,7 @@ func TestConcurrentRefresh(t *testing.T) {
 	b.Unlock()
 
 	for i := 0; i < numDials; i++ {
-		if err := <-ch; err != errFakeDial {
+		if err := <-ch; !errors.Is(err, errFakeDial) {
 			t.Errorf("unexpected error: %v", err)
 		}
 	}
@@ -131,6 +247,34 @@ func TestConcurrentRefresh(t *testing.T) {
 	b.Unlock()
 }
 
+func TestDialErrorContext(t *testing.T) {
+	c := &Client{
+		Certs: &blockingCertSource{
+			map[string]*fakeCerts{instance: &fakeCerts{}},
+			forever,
+		},
+		Dialer: func(string, string) (net.Conn, error) {
+			return nil, errFakeDial
+		},
+		Port: 3307,
+	}
+	_, err := c.Dial(instance)
+	if !errors.Is(err, errFakeDial) {
+		t.Fatalf("Dial error %v does not wrap %v", err, errFakeDial)
+	}
+	for _, want := range []string{instance, "fake address:3307"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Dial error %q does not mention %q", err, want)
+		}
+	}
+
+	errCerts := errors.New("certificate request failed")
+	c.Certs = &failingCertSource{errCerts}
+	if _, err := c.Dial("other-instance"); !errors.Is(err, errCerts) || !strings.Contains(err.Error(), "other-instance") {
+		t.Errorf("Dial error for a failed refresh = %v, want it to wrap %v and name the instance", err, errCerts)
+	}
+}
+
 func TestMaximumConnectionsCount(t *testing.T) {
 	const maxConnections = 10
 	const numConnections = maxConnections + 1
@@ -193,6 +337,38 @@ func TestMaximumConnectionsCount(t *testing.T) {
 	}
 }
 
+func TestAllowedInstances(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		instance string
+		dial     bool
+	}{
+		{"allowed", "proj:region:allowed", true},
+		{"denied", "proj:region:other", false},
+		{"wildcard", "proj:wild:any", true},
+		{"wildcard other region", "proj:wildcard:any", false},
+	} {
+		var dials uint64
+		c := &Client{
+			Certs: &blockingCertSource{
+				map[string]*fakeCerts{tc.instance: &fakeCerts{}},
+				forever,
+			},
+			Dialer: func(string, string) (net.Conn, error) {
+				atomic.AddUint64(&dials, 1)
+				return nil, errFakeDial
+			},
+			AllowedInstances: []string{"proj:region:allowed", "proj:wild:*"},
+		}
+
+		c.handleConn(Conn{Instance: tc.instance, Conn: &dummyConn{}})
+
+		if got := dials > 0; got != tc.dial {
+			t.Errorf("%s: connection to %q dialed = %v, want %v", tc.desc, tc.instance, got, tc.dial)
+		}
+	}
+}
+
 func TestShutdownTerminatesEarly(t *testing.T) {
 	b := &fakeCerts{}
 	c := &Client{
@@ -245,7 +421,7 @@ func TestRefreshTimer(t *testing.T) {
 		RefreshCfgThrottle: 20 * time.Millisecond,
 	}
 	// Call Dial to cache the cert.
-	if _, err := c.Dial(instance); err != errFakeDial {
+	if _, err := c.Dial(instance); !errors.Is(err, errFakeDial) {
 		t.Fatalf("Dial(%s) failed: %v", instance, err)
 	}
 	c.cacheL.Lock()
@@ -267,3 +443,400 @@ func TestRefreshTimer(t *testing.T) {
 		t.Error("expected cert to be refreshed.")
 	}
 }
+
+func TestConnectionIDInLogs(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	c, servers := newTLSClient(t, nil)
+	client, local := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+
+	// Closing the instance side ends the tunnel.
+	(<-servers).Close()
+	<-done
+	restore()
+
+	idRE := regexp.MustCompile(`\(connection (\d+)\)`)
+	var openID, closeID string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		m := idRE.FindStringSubmatch(line)
+		switch {
+		case m == nil:
+		case strings.Contains(line, "Opened"):
+			openID = m[1]
+		case strings.Contains(line, "closed connection"):
+			closeID = m[1]
+		}
+	}
+	if openID == "" || closeID == "" {
+		t.Fatalf("missing open or close line in log:\n%s", buf)
+	}
+	if openID != closeID {
+		t.Errorf("open line has connection %s, close line has connection %s:\n%s", openID, closeID, buf)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	c, servers := newTLSClient(t, nil)
+	c.AccessLog = true
+	client, local := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+
+	server := <-servers
+	if _, err := client.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	<-done
+	restore()
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "access:") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %d access log lines, want 1:\n%s", len(lines), buf)
+	}
+	for _, field := range []string{
+		`instance="instance-name"`,
+		"client=pipe",
+		"local=pipe",
+		"start=",
+		"duration=",
+		"bytes_up=5",
+		"bytes_down=0",
+		`closer="instance"`,
+		`error=""`,
+	} {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("access log line %q is missing %q", lines[0], field)
+		}
+	}
+}
+
+func TestConnectionLogFields(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	logging.SetJSON(true)
+	defer logging.SetJSON(false)
+
+	c, servers := newTLSClient(t, nil)
+	client, local := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+	(<-servers).Close()
+	<-done
+	restore()
+
+	var found int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON (%q): %v", line, err)
+		}
+		msg, _ := entry["message"].(string)
+		if !strings.Contains(msg, "(connection ") {
+			continue
+		}
+		found++
+		if entry["instance"] != instance {
+			t.Errorf("line %q: instance field is %v, want %q", line, entry["instance"], instance)
+		}
+		if _, ok := entry["connection"].(float64); !ok {
+			t.Errorf("line %q: connection field is %v, want a number", line, entry["connection"])
+		}
+	}
+	if found < 2 {
+		t.Errorf("got %d per-connection lines, want the open and close lines:\n%s", found, buf)
+	}
+}
+
+func TestTLSVersionAndCipherSuites(t *testing.T) {
+	var hello *tls.ClientHelloInfo
+	c, servers := newTLSClient(t, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, nil
+		},
+	})
+	c.MinTLSVersion = tls.VersionTLS13
+	c.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+
+	conn, err := c.Dial(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-servers
+	defer func() {
+		// net.Pipe is unbuffered, so the server must read the client's
+		// close_notify alert for Close to return promptly.
+		go io.Copy(ioutil.Discard, server)
+		conn.Close()
+		server.Close()
+	}()
+
+	if want := []uint16{tls.VersionTLS13}; !reflect.DeepEqual(hello.SupportedVersions, want) {
+		t.Errorf("client offered TLS versions %x, want %x", hello.SupportedVersions, want)
+	}
+	if v := server.(*tls.Conn).ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Errorf("negotiated TLS version %x, want %x", v, tls.VersionTLS13)
+	}
+
+	c.cacheL.RLock()
+	cfg := c.cfgCache[instance].cfg
+	c.cacheL.RUnlock()
+	if cfg.MinVersion != tls.VersionTLS13 || !reflect.DeepEqual(cfg.CipherSuites, c.CipherSuites) {
+		t.Errorf("cached config has MinVersion %x and CipherSuites %x, want %x and %x", cfg.MinVersion, cfg.CipherSuites, tls.VersionTLS13, c.CipherSuites)
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	var got []TunnelStats
+	c, servers := newTLSClient(t, nil)
+	c.OnClose = func(s TunnelStats) { got = append(got, s) }
+	client, local := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+
+	server := <-servers
+	defer server.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// Let the server see the tunnel close its side.
+	go io.Copy(ioutil.Discard, server)
+	client.Close()
+	<-done
+
+	if len(got) != 1 {
+		t.Fatalf("OnClose called %d times, want 1", len(got))
+	}
+	s := got[0]
+	if s.Instance != instance || s.BytesUp != 5 || s.BytesDown != 3 || s.ClosedBy != "client" || s.Err != nil {
+		t.Errorf("got stats %+v, want instance %q, 5 bytes up, 3 down, closed cleanly by the client", s, instance)
+	}
+	if s.Duration <= 0 || s.Start.IsZero() {
+		t.Errorf("got start %v and duration %v, want both set", s.Start, s.Duration)
+	}
+}
+
+// metric returns the current value of key in the expvar metrics, or 0 if it
+// has not been set yet.
+func metric(key string) int64 {
+	if v, ok := metrics.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	before := make(map[string]int64)
+	for _, k := range []string{"bytes_up", "bytes_down", "active_tunnels", "total_tunnels"} {
+		before[k] = metric(k)
+	}
+
+	c, servers := newTLSClient(t, nil)
+	client, local := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+
+	server := <-servers
+	defer server.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric("active_tunnels") - before["active_tunnels"]; got != 1 {
+		t.Errorf("active_tunnels went up by %d while the tunnel was open, want 1", got)
+	}
+	go io.Copy(ioutil.Discard, server)
+	client.Close()
+	<-done
+
+	want := map[string]int64{"bytes_up": 5, "bytes_down": 3, "active_tunnels": 0, "total_tunnels": 1}
+	for k, w := range want {
+		if got := metric(k) - before[k]; got != w {
+			t.Errorf("%s went up by %d, want %d", k, got, w)
+		}
+	}
+}
+
+func TestTLSConfigFunc(t *testing.T) {
+	c, servers := newTLSClient(t, nil)
+	pool := x509.NewCertPool()
+	var verified bool
+	c.TLSConfigFunc = func(cfg *tls.Config) *tls.Config {
+		cfg.RootCAs = pool
+		verify := cfg.VerifyPeerCertificate
+		cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			verified = true
+			return verify(raw, chains)
+		}
+		return cfg
+	}
+
+	conn, err := c.Dial(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-servers
+	defer func() {
+		go io.Copy(ioutil.Discard, server)
+		conn.Close()
+		server.Close()
+	}()
+
+	if !verified {
+		t.Error("the VerifyPeerCertificate set by TLSConfigFunc was not used")
+	}
+	c.cacheL.RLock()
+	cfg := c.cfgCache[instance].cfg
+	c.cacheL.RUnlock()
+	if cfg.RootCAs != pool {
+		t.Error("cached config does not use the RootCAs set by TLSConfigFunc")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	type report struct {
+		instance string
+		err      error
+	}
+	reports := make(chan report, 10)
+	errCerts := errors.New("credentials revoked")
+	c := &Client{
+		Certs:   &failingCertSource{errCerts},
+		OnError: func(instance string, err error) { reports <- report{instance, err} },
+	}
+
+	for i := 0; i < 3; i++ {
+		c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	}
+	for i := 0; i < 3; i++ {
+		r := <-reports
+		if r.instance != instance || !errors.Is(r.err, errCerts) {
+			t.Errorf("report %d: got (%q, %v), want (%q, an error wrapping %v)", i, r.instance, r.err, instance, errCerts)
+		}
+	}
+
+	c.MaxConnections = 1
+	c.ConnectionsCounter = 1
+	c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	if r := <-reports; !errors.Is(r.err, ErrTooManyConnections) {
+		t.Errorf("got %v for a connection over the limit, want an error wrapping %v", r.err, ErrTooManyConnections)
+	}
+}
+
+func TestSlowRefreshWarning(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	for _, tc := range []struct {
+		threshold time.Duration
+		warn      bool
+	}{
+		{10 * time.Millisecond, true},
+		{time.Minute, false},
+		{-1, false},
+	} {
+		buf.Reset()
+		c := &Client{
+			Certs: &slowCertSource{
+				&blockingCertSource{map[string]*fakeCerts{instance: &fakeCerts{}}, forever},
+				20 * time.Millisecond,
+			},
+			Dialer: func(string, string) (net.Conn, error) {
+				return nil, errFakeDial
+			},
+			SlowRefreshThreshold: tc.threshold,
+		}
+		if _, err := c.Dial(instance); !errors.Is(err, errFakeDial) {
+			t.Fatalf("Dial(%s) failed: %v", instance, err)
+		}
+		got := strings.Contains(buf.String(), fmt.Sprintf("Refreshing the configuration for %q took", instance))
+		if got != tc.warn {
+			t.Errorf("threshold %v: warning logged = %v, want %v; log:\n%s", tc.threshold, got, tc.warn, buf)
+		}
+	}
+}
+
+// recordingLogger records every message it receives.
+type recordingLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(format string, v ...interface{}) {
+	l.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func (l *recordingLogger) Infof(format string, v ...interface{})    { l.record(format, v...) }
+func (l *recordingLogger) Warningf(format string, v ...interface{}) { l.record(format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...interface{})   { l.record(format, v...) }
+
+func TestClientLogger(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	l := &recordingLogger{}
+	c := &Client{
+		Certs:  &failingCertSource{errors.New("credentials revoked")},
+		Logger: l,
+	}
+	c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+
+	if len(l.msgs) != 1 || !strings.Contains(l.msgs[0], "couldn't connect to") {
+		t.Errorf("Client.Logger got %q, want the connection error", l.msgs)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("standard logger received output: %q", buf.String())
+	}
+}
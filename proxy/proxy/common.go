@@ -18,10 +18,13 @@ package proxy
 import (
 	"bytes"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 )
@@ -52,10 +55,21 @@ func (d dbgConn) Close() error {
 	return err
 }
 
+// metrics is published through expvar as "cloudsql_proxy", which programs
+// serving http.DefaultServeMux expose on /debug/vars. It counts the bytes
+// copied up (client to instance) and down, and the active and total number of
+// tunnels, across all Clients in the process.
+var metrics = expvar.NewMap("cloudsql_proxy")
+
+// defaultBufferSize is the size of each direction's copy buffer when
+// tunnelOpts.bufferSize is not set.
+const defaultBufferSize = 16 * 1024
+
 // myCopy is similar to io.Copy, but reports whether the returned error was due
-// to a bad read or write. The returned error will never be nil
-func myCopy(dst io.Writer, src io.Reader) (readErr bool, err error) {
-	buf := make([]byte, 4096)
+// to a bad read or write. The returned error will never be nil. Data is read
+// into buf, and copied is called with the number of bytes after every
+// successful write to dst.
+func myCopy(dst io.Writer, src io.Reader, buf []byte, copied func(n int)) (readErr bool, err error) {
 	for {
 		n, err := src.Read(buf)
 		if n > 0 {
@@ -66,6 +80,7 @@ func myCopy(dst io.Writer, src io.Reader) (readErr bool, err error) {
 				// Read and write error; just report read error (it happened first).
 				return true, err
 			}
+			copied(n)
 		}
 		if err != nil {
 			return true, err
@@ -73,48 +88,208 @@ func myCopy(dst io.Writer, src io.Reader) (readErr bool, err error) {
 	}
 }
 
-func copyError(readDesc, writeDesc string, readErr bool, err error) {
+// connLogger writes the log messages about a single connection.
+// logging.FieldLogger implements it.
+type connLogger interface {
+	Verbosef(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+func copyError(logger connLogger, readDesc, writeDesc string, readErr bool, err error) {
 	var desc string
 	if readErr {
 		desc = "Reading data from " + readDesc
 	} else {
 		desc = "Writing data to " + writeDesc
 	}
-	logging.Errorf("%v had error: %v", desc, err)
+	logger.Warningf("%v had error: %v", desc, err)
+}
+
+// closedBy names the side that ended a tunnel, given the result of myCopy
+// copying from the side called src to the side called dst. The returned error
+// is nil if src closed cleanly.
+func closedBy(src, dst string, readErr bool, err error) (string, error) {
+	switch {
+	case readErr && err == io.EOF:
+		return src, nil
+	case readErr:
+		return src, err
+	default:
+		return dst, err
+	}
+}
+
+// tunnelOpts holds the optional settings copyThenClose applies to a single
+// tunnel. The zero value imposes no limits.
+type tunnelOpts struct {
+	// idleTimeout, if positive, closes the tunnel once no data has been
+	// copied in either direction for this long.
+	idleTimeout time.Duration
+	// maxAge, if positive, closes the tunnel this long after it started,
+	// whether or not it is in use.
+	maxAge time.Duration
+	// onClose, if not nil, is called once after the tunnel is closed with the
+	// side that closed it ("client", "instance" or "proxy"), the error that
+	// ended it (nil for a clean close) and the number of bytes copied from
+	// local to remote (up) and from remote to local (down).
+	onClose func(closer string, err error, up, down uint64)
+	// bufferSize is the size of the buffer used for each direction of the
+	// tunnel. If not positive, defaultBufferSize is used.
+	bufferSize int
+	// drainTimeout, if positive, keeps copying from remote to local for up
+	// to this long after local reaches EOF, so that data the remote is still
+	// sending is not lost.
+	drainTimeout time.Duration
+	// writeTimeout, if positive, gives up on a write to local that has not
+	// completed within this long, for example because the client stopped
+	// reading. It has no effect if local cannot set write deadlines.
+	writeTimeout time.Duration
+	// initialReadTimeout, if positive, closes the tunnel if no data has been
+	// received from local this long after the tunnel started.
+	initialReadTimeout time.Duration
+}
+
+// writeDeadliner is implemented by connections that support write deadlines,
+// such as net.Conn.
+type writeDeadliner interface {
+	io.Writer
+	SetWriteDeadline(time.Time) error
+}
+
+// deadlineWriter sets a write deadline timeout from now before every Write.
+type deadlineWriter struct {
+	w       writeDeadliner
+	timeout time.Duration
+}
+
+func (d deadlineWriter) Write(b []byte) (int, error) {
+	if err := d.w.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.w.Write(b)
 }
 
-func copyThenClose(remote, local io.ReadWriteCloser, remoteDesc, localDesc string) {
+func copyThenClose(remote, local io.ReadWriteCloser, remoteDesc, localDesc string, logger connLogger, opts tunnelOpts) {
 	firstErr := make(chan error, 1)
 
+	var up, down uint64
+	var copies sync.WaitGroup
+	copies.Add(2)
+	tornDown := make(chan struct{})
+
+	// finish closes both sides of the tunnel. Only whoever wins the send on
+	// firstErr calls it, so it runs exactly once.
+	finish := func(closer string, err error) {
+		remote.Close()
+		local.Close()
+		if opts.onClose != nil {
+			copies.Wait()
+			opts.onClose(closer, err, atomic.LoadUint64(&up), atomic.LoadUint64(&down))
+		}
+		close(tornDown)
+	}
+
+	// closeAfter tears the tunnel down unless one of the copies has already
+	// finished and done so.
+	closeAfter := func(d time.Duration, why string) *time.Timer {
+		return time.AfterFunc(d, func() {
+			err := fmt.Errorf("%s (%v)", why, d)
+			select {
+			case firstErr <- err:
+				logger.Verbosef("Closing %v: %v", localDesc, err)
+				finish("proxy", err)
+			default:
+			}
+		})
+	}
+
+	activity := func(int) {}
+	if opts.idleTimeout > 0 {
+		idle := closeAfter(opts.idleTimeout, "idle timeout")
+		defer idle.Stop()
+		activity = func(int) { idle.Reset(opts.idleTimeout) }
+	}
+	if opts.maxAge > 0 {
+		defer closeAfter(opts.maxAge, "maximum connection age").Stop()
+	}
+	// initial is stopped, and then cleared, on the first data copied from
+	// local.
+	var initial *time.Timer
+	if opts.initialReadTimeout > 0 {
+		initial = closeAfter(opts.initialReadTimeout, "no data received from client")
+		defer initial.Stop()
+	}
+
+	bufferSize := opts.bufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	var toLocal io.Writer = local
+	if opts.writeTimeout > 0 {
+		if w, ok := local.(writeDeadliner); ok {
+			toLocal = deadlineWriter{w, opts.writeTimeout}
+		}
+	}
+
+	// remoteDone is closed once copying from remote to local has stopped.
+	remoteDone := make(chan struct{})
+
 	go func() {
-		readErr, err := myCopy(remote, local)
+		readErr, err := myCopy(remote, local, make([]byte, bufferSize), func(n int) {
+			atomic.AddUint64(&up, uint64(n))
+			metrics.Add("bytes_up", int64(n))
+			if initial != nil {
+				initial.Stop()
+				initial = nil
+			}
+			activity(n)
+		})
+		copies.Done()
+		if readErr && err == io.EOF && opts.drainTimeout > 0 {
+			// Give the remote a chance to finish sending its response
+			// before the tunnel is closed.
+			drain := time.NewTimer(opts.drainTimeout)
+			select {
+			case <-remoteDone:
+			case <-drain.C:
+			}
+			drain.Stop()
+		}
 		select {
 		case firstErr <- err:
 			if readErr && err == io.EOF {
-				logging.Verbosef("Client closed %v", localDesc)
+				logger.Verbosef("Client closed %v", localDesc)
 			} else {
-				copyError(localDesc, remoteDesc, readErr, err)
+				copyError(logger, localDesc, remoteDesc, readErr, err)
 			}
-			remote.Close()
-			local.Close()
+			finish(closedBy("client", "instance", readErr, err))
 		default:
 		}
 	}()
 
-	readErr, err := myCopy(local, remote)
+	readErr, err := myCopy(toLocal, remote, make([]byte, bufferSize), func(n int) {
+		atomic.AddUint64(&down, uint64(n))
+		metrics.Add("bytes_down", int64(n))
+		activity(n)
+	})
+	copies.Done()
+	close(remoteDone)
 	select {
 	case firstErr <- err:
 		if readErr && err == io.EOF {
-			logging.Verbosef("Instance %v closed connection", remoteDesc)
+			logger.Verbosef("Instance %v closed connection", remoteDesc)
 		} else {
-			copyError(remoteDesc, localDesc, readErr, err)
+			copyError(logger, remoteDesc, localDesc, readErr, err)
 		}
-		remote.Close()
-		local.Close()
+		finish(closedBy("instance", "client", readErr, err))
 	default:
 		// In this case, the other goroutine exited first and already printed its
 		// error (and closed the things).
 	}
+	<-tornDown
 }
 
 // NewConnSet initializes a new ConnSet and returns it.
@@ -175,6 +350,22 @@ func (c *ConnSet) IDs() []string {
 	return ret
 }
 
+// Stats returns the number of active connections for each identifier that
+// has any.
+func (c *ConnSet) Stats() map[string]int {
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	ret := make(map[string]int, len(c.m))
+	for id, conns := range c.m {
+		ret[id] = len(conns)
+	}
+	return ret
+}
+
 // Conns returns all active connections associated with the provided ids.
 func (c *ConnSet) Conns(ids ...string) []net.Conn {
 	if c == nil {
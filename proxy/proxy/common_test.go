@@ -17,9 +17,14 @@
 package proxy
 
 import (
+	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
 )
 
 var c1, c2, c3 = &dummyConn{}, &dummyConn{}, &dummyConn{}
@@ -113,3 +118,271 @@ func TestConns(t *testing.T) {
 		t.Fatalf("didn't find %v in list of Conns", looking)
 	}
 }
+
+func TestConnSetStats(t *testing.T) {
+	s := NewConnSet()
+	const n = 5
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		c := &dummyConn{}
+		conns = append(conns, c)
+		s.Add("a", c)
+	}
+	s.Add("b", c3)
+
+	want := map[string]int{"a": n, "b": 1}
+	if got := s.Stats(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, c := range conns {
+		if err := s.Remove("a", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("b", c3)
+	if got := s.Stats(); len(got) != 0 {
+		t.Fatalf("got %v, want no active connections", got)
+	}
+}
+
+// startTunnel runs copyThenClose between two in-memory pipes. It returns the
+// far ends of the remote and local sides and a channel closed once
+// copyThenClose returns.
+func startTunnel(opts tunnelOpts) (remote, local net.Conn, done <-chan struct{}) {
+	remote, remoteNear := net.Pipe()
+	local, localNear := net.Pipe()
+	ch := make(chan struct{})
+	go func() {
+		copyThenClose(remoteNear, localNear, "remote", "local", logging.FieldLogger{}, opts)
+		close(ch)
+	}()
+	return remote, local, ch
+}
+
+func TestCopyThenCloseIdleTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	remote, local, done := startTunnel(tunnelOpts{idleTimeout: timeout})
+	defer remote.Close()
+	defer local.Close()
+
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("idle tunnel was not closed within 1s (idle timeout %v)", timeout)
+	}
+	if got := time.Since(start); got < timeout {
+		t.Errorf("tunnel closed after %v, want at least %v", got, timeout)
+	}
+	if _, err := local.Read(make([]byte, 1)); err == nil {
+		t.Error("local side is still open after the idle timeout")
+	}
+}
+
+func TestCopyThenCloseMaxAge(t *testing.T) {
+	const maxAge = 100 * time.Millisecond
+	remote, local, done := startTunnel(tunnelOpts{maxAge: maxAge})
+	defer remote.Close()
+	defer local.Close()
+
+	// Keep data flowing from the instance to the client until the tunnel is
+	// closed underneath us.
+	go func() {
+		for {
+			if _, err := remote.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 16)
+	for {
+		if _, err := local.Read(buf); err != nil {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("active tunnel was not closed within 1s (max age %v)", maxAge)
+		}
+	}
+	<-done
+	if got := time.Since(start); got < maxAge {
+		t.Errorf("tunnel closed after %v, want at least %v", got, maxAge)
+	}
+}
+
+func TestCopyThenCloseOnClose(t *testing.T) {
+	type entry struct {
+		closer   string
+		err      error
+		up, down uint64
+	}
+	var got []entry
+	remote, local, done := startTunnel(tunnelOpts{
+		onClose: func(closer string, err error, up, down uint64) {
+			got = append(got, entry{closer, err, up, down})
+		},
+	})
+	defer remote.Close()
+
+	buf := make([]byte, 16)
+	if _, err := local.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(remote, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(local, buf[:3]); err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+	<-done
+
+	want := []entry{{"client", nil, 5, 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("onClose calls: got %+v, want %+v", got, want)
+	}
+}
+
+// readSizeConn records the length of the buffers passed to Read.
+type readSizeConn struct {
+	net.Conn
+	sizes chan int
+}
+
+func (c readSizeConn) Read(b []byte) (int, error) {
+	select {
+	case c.sizes <- len(b):
+	default:
+	}
+	return c.Conn.Read(b)
+}
+
+func TestCopyThenCloseBufferSize(t *testing.T) {
+	for _, tc := range []struct {
+		bufferSize, want int
+	}{
+		{0, defaultBufferSize},
+		{256 * 1024, 256 * 1024},
+	} {
+		remote, remoteNear := net.Pipe()
+		local, localNear := net.Pipe()
+		sizes := make(chan int, 1)
+		done := make(chan struct{})
+		go func() {
+			copyThenClose(readSizeConn{remoteNear, sizes}, localNear, "remote", "local", logging.FieldLogger{}, tunnelOpts{bufferSize: tc.bufferSize})
+			close(done)
+		}()
+
+		if got := <-sizes; got != tc.want {
+			t.Errorf("bufferSize %d: read into a buffer of %d bytes, want %d", tc.bufferSize, got, tc.want)
+		}
+		remote.Close()
+		local.Close()
+		<-done
+	}
+}
+
+func TestCopyThenCloseDrainTimeout(t *testing.T) {
+	// The local side needs TCP so the client can half-close it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	localNear, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, remoteNear := net.Pipe()
+	defer remote.Close()
+	done := make(chan struct{})
+	go func() {
+		copyThenClose(remoteNear, localNear, "remote", "local", logging.FieldLogger{}, tunnelOpts{drainTimeout: time.Second})
+		close(done)
+	}()
+
+	// The client finishes sending; the remote answers afterwards.
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := remote.Write([]byte("tail")); err != nil {
+		t.Fatalf("remote write after client EOF failed: %v", err)
+	}
+	remote.Close()
+
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "tail" {
+		t.Errorf("client received %q, want %q", got, "tail")
+	}
+	<-done
+}
+
+func TestCopyThenCloseWriteTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	remote, local, done := startTunnel(tunnelOpts{writeTimeout: timeout})
+	defer remote.Close()
+	defer local.Close()
+
+	// The client never reads from local, so forwarding soon blocks.
+	go func() {
+		for {
+			if _, err := remote.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("tunnel to a client that stopped reading was not closed within 1s (write timeout %v)", timeout)
+	}
+}
+
+func TestCopyThenCloseInitialReadTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	// A client that never sends anything is disconnected.
+	remote, local, done := startTunnel(tunnelOpts{initialReadTimeout: timeout})
+	defer remote.Close()
+	defer local.Close()
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("silent tunnel was not closed within 1s (initial read timeout %v)", timeout)
+	}
+	if got := time.Since(start); got < timeout {
+		t.Errorf("tunnel closed after %v, want at least %v", got, timeout)
+	}
+
+	// Once the client has sent data, the timeout no longer applies.
+	remote, local, done = startTunnel(tunnelOpts{initialReadTimeout: timeout})
+	defer remote.Close()
+	defer local.Close()
+	go io.Copy(ioutil.Discard, remote)
+	if _, err := local.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("tunnel was closed after the client sent data")
+	case <-time.After(3 * timeout):
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// impersonatedTokenSource implements oauth2.TokenSource by asking the IAM
+// Credentials API for access tokens belonging to another service account.
+type impersonatedTokenSource struct {
+	ctx       context.Context
+	serv      *iamcredentials.Service
+	target    string
+	delegates []string
+	scopes    []string
+}
+
+func serviceAccountResource(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
+
+// Token helps impersonatedTokenSource implement oauth2.TokenSource.
+func (src *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	req := &iamcredentials.GenerateAccessTokenRequest{
+		Delegates: src.delegates,
+		Scope:     src.scopes,
+	}
+	resp, err := src.serv.Projects.ServiceAccounts.GenerateAccessToken(serviceAccountResource(src.target), req).Context(src.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %q: %v", src.target, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %q: invalid expire time %q: %v", src.target, resp.ExpireTime, err)
+	}
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		Expiry:      expiry,
+	}, nil
+}
+
+// ImpersonatedTokenSource returns a TokenSource producing access tokens for
+// the target service account with the provided scopes. The tokens are obtained
+// from the IAM Credentials API using the credentials in base, which must be
+// allowed to act as target (roles/iam.serviceAccountTokenCreator).
+//
+// delegates is an optional delegation chain, ordered starting from the
+// account behind base: each account must be allowed to act as the next one,
+// and the last one must be allowed to act as target.
+//
+// opts are passed on to the IAM Credentials API client.
+func ImpersonatedTokenSource(ctx context.Context, base oauth2.TokenSource, target string, delegates, scopes []string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	opts = append([]option.ClientOption{option.WithTokenSource(base)}, opts...)
+	serv, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []string
+	for _, d := range delegates {
+		resources = append(resources, serviceAccountResource(d))
+	}
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		ctx:       ctx,
+		serv:      serv,
+		target:    target,
+		delegates: resources,
+		scopes:    scopes,
+	}), nil
+}
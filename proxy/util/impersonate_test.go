@@ -0,0 +1,121 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// selfSignedPEM returns a PEM-encoded self-signed certificate.
+func selfSignedPEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "my-db"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	const target = "db-access@proj.iam.gserviceaccount.com"
+
+	var gotReq struct {
+		Delegates []string `json:"delegates"`
+		Scope     []string `json:"scope"`
+	}
+	var gotAuth, gotPath string
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotPath = r.Header.Get("Authorization"), r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&gotReq); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": "impersonated-token",
+			"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	}))
+	defer iam.Close()
+
+	// api stands in for the Cloud SQL Admin API: it records the token used
+	// to request the ephemeral certificate.
+	cert := selfSignedPEM(t)
+	var apiAuth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/createEphemeral") {
+			http.NotFound(w, r)
+			return
+		}
+		apiAuth = r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(&sqladmin.SslCert{Cert: cert})
+	}))
+	defer api.Close()
+
+	ctx := context.Background()
+	base := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base-token"})
+	scopes := []string{"https://www.googleapis.com/auth/sqlservice.admin"}
+	src, err := util.ImpersonatedTokenSource(ctx, base, target, []string{"delegate@proj.iam.gserviceaccount.com"}, scopes, option.WithEndpoint(iam.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certSrc := certs.NewCertSourceOpts(oauth2.NewClient(ctx, src), certs.RemoteOpts{APIBasePath: api.URL + "/"})
+	if _, err := certSrc.Local("proj:region:my-db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "/v1/projects/-/serviceAccounts/" + target + ":generateAccessToken"; gotPath != want {
+		t.Errorf("IAM credentials path: got %q, want %q", gotPath, want)
+	}
+	if want := "Bearer base-token"; gotAuth != want {
+		t.Errorf("IAM credentials authorization: got %q, want %q", gotAuth, want)
+	}
+	if want := []string{"projects/-/serviceAccounts/delegate@proj.iam.gserviceaccount.com"}; !reflect.DeepEqual(gotReq.Delegates, want) {
+		t.Errorf("delegates: got %v, want %v", gotReq.Delegates, want)
+	}
+	if !reflect.DeepEqual(gotReq.Scope, scopes) {
+		t.Errorf("scopes: got %v, want %v", gotReq.Scope, scopes)
+	}
+	if want := "Bearer impersonated-token"; apiAuth != want {
+		t.Errorf("createEphemeral authorization: got %q, want %q", apiAuth, want)
+	}
+}